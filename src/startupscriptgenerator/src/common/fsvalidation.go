@@ -6,12 +6,32 @@
 package common
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 )
 
+// sha256SidecarSuffix is appended to a script's path to form the path of its digest sidecar,
+// as written by WriteScriptIfChanged.
+const sha256SidecarSuffix = ".sha256"
+
+// defaultOutputDirMode is the directory mode used for shared output directories when
+// ORYX_OUTPUT_DIR_MODE is not set.
+const defaultOutputDirMode = os.FileMode(0755)
+
+// Matches Cygwin/MSYS/WSL style drive paths such as "/c/src/app", "/cygdrive/c/src/app", or
+// the WSL form "/mnt/c/src/app".
+var cygwinDriveRe = regexp.MustCompile(`^/(?:cygdrive/|mnt/)?([a-zA-Z])(/.*)?$`)
+
 func PathExists(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
@@ -26,62 +46,293 @@ func FileExists(path string) bool {
 }
 
 func GetSubPath(parentDir string, subDir string) string {
-	parentDir = filepath.Clean(parentDir)
-	subDir = filepath.Clean(subDir)
-	if len(parentDir) >= len(subDir) {
+	if relPath, ok := relSubPath(filepath.Clean(parentDir), filepath.Clean(subDir)); ok {
+		return relPath
+	}
+
+	// parentDir and subDir didn't share a literal prefix -- this happens when parentDir is
+	// reached through a symlinked mount (e.g. a container source directory) and subDir is
+	// expressed in its already-resolved form. Retry against the canonicalized parent. subDir is
+	// deliberately left as-is: it may not exist yet, so canonicalizing it independently can
+	// leave part of it unresolved and produce a path that's inconsistent with the parent.
+	canonicalParent, err := CanonicalizePath(parentDir, false)
+	if err != nil {
 		return ""
 	}
-	return subDir[len(parentDir)+1:]
+
+	relPath, ok := relSubPath(canonicalParent, filepath.Clean(subDir))
+	if !ok {
+		return ""
+	}
+	return relPath
+}
+
+// relSubPath returns the path of subDir relative to parentDir, and whether subDir is actually
+// nested strictly under parentDir.
+func relSubPath(parentDir string, subDir string) (string, bool) {
+	rel, err := filepath.Rel(parentDir, subDir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// CanonicalizePath resolves path to its canonical, absolute form: it normalizes Cygwin/MSYS
+// style drive paths to their native Windows form, absolutizes the result, and then resolves
+// any symlinks in it. When missingOk is true and the path does not exist, the absolutized but
+// symlink-unresolved form is returned instead of an error.
+func CanonicalizePath(path string, missingOk bool) (string, error) {
+	path = convertCygwinPath(path)
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path for '%s': %w", path, err)
+	}
+
+	resolvedPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		if missingOk && os.IsNotExist(err) {
+			return absPath, nil
+		}
+		return "", fmt.Errorf("failed to canonicalize path '%s': %w", absPath, err)
+	}
+	return resolvedPath, nil
+}
+
+// convertCygwinPath rewrites Cygwin/MSYS/WSL style drive paths (e.g. "/c/src/app",
+// "/cygdrive/c/src/app", or "/mnt/c/src/app") to their native Windows form ("C:\src\app"). It is
+// a no-op on platforms other than Windows, and on paths that don't match the Cygwin/MSYS/WSL
+// drive form.
+func convertCygwinPath(path string) string {
+	if runtime.GOOS != "windows" {
+		return path
+	}
+
+	matches := cygwinDriveRe.FindStringSubmatch(path)
+	if matches == nil {
+		return path
+	}
+
+	drive := strings.ToUpper(matches[1])
+	rest := strings.ReplaceAll(matches[2], "/", `\`)
+	return drive + ":" + rest
+}
+
+// ExpandUserPath expands a leading "~", "~/" or "~username/" in p to the relevant user's home
+// directory, and applies os.ExpandEnv so that "$VAR" and "${VAR}" references are resolved.
+func ExpandUserPath(p string) (string, error) {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		currentUser, err := user.Current()
+		if err != nil {
+			return "", fmt.Errorf("failed to determine current user's home directory: %w", err)
+		}
+		p = filepath.Join(currentUser.HomeDir, strings.TrimPrefix(p, "~"))
+	} else if strings.HasPrefix(p, "~") {
+		if idx := strings.Index(p, "/"); idx >= 0 {
+			username := p[1:idx]
+			lookedUpUser, err := user.Lookup(username)
+			if err != nil {
+				return "", fmt.Errorf("failed to look up home directory for user '%s': %w", username, err)
+			}
+			p = filepath.Join(lookedUpUser.HomeDir, p[idx+1:])
+		}
+	}
+
+	return os.ExpandEnv(p), nil
+}
+
+// GetValidatedFullPathE gets the full path from a relative path, and ensures the path exists.
+// Unlike GetValidatedFullPath, it returns an error rather than panicking.
+func GetValidatedFullPathE(filePath string) (string, error) {
+	expandedPath, err := ExpandUserPath(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	fullAppPath, err := CanonicalizePath(expandedPath, false)
+	if err != nil {
+		return "", fmt.Errorf("path '%s' does not exist: %w", filePath, err)
+	}
+	return fullAppPath, nil
 }
 
 // Gets the full path from a relative path, and ensure the path exists.
+//
+// Deprecated: use GetValidatedFullPathE instead, which returns an error instead of panicking.
 func GetValidatedFullPath(filePath string) string {
-	fullAppPath, err := filepath.Abs(filePath)
+	fullAppPath, err := GetValidatedFullPathE(filePath)
 	if err != nil {
 		panic(err)
 	}
+	return fullAppPath
+}
+
+// RenameFileCopyPermissions renames src to dst, first copying dst's existing file mode onto
+// src if dst already exists, so permissions (including setuid/setgid bits) aren't lost when the
+// rename replaces it. Modeled after the equivalent helper in git-lfs's tools/filetools.go.
+func RenameFileCopyPermissions(src, dst string) error {
+	dstInfo, err := os.Stat(dst)
+	if err == nil {
+		if err := os.Chmod(src, dstInfo.Mode()); err != nil {
+			return fmt.Errorf("failed to copy permissions from '%s' to '%s': %w", dst, src, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to stat '%s': %w", dst, err)
+	}
 
-	if _, err := os.Stat(fullAppPath); os.IsNotExist(err) {
-		panic("Path '" + fullAppPath + "' does not exist.")
+	if err := os.Rename(src, dst); err != nil {
+		return fmt.Errorf("failed to rename '%s' to '%s': %w", src, dst, err)
 	}
-	return fullAppPath
+	return nil
 }
 
-// Writes the entrypoint command to an executable file
-func WriteScript(filePath string, command string) {
+// MkdirAllShared creates path (and any missing parents) such that perm is the actual on-disk
+// mode, regardless of the process' umask. This matters for output volumes that are later
+// consumed by a different, non-root runtime user (e.g. Azure App Service or a Kubernetes
+// init-container setup), where the inherited umask would otherwise mask the requested
+// permissions down. On Windows, which has no umask, this is equivalent to os.MkdirAll.
+func MkdirAllShared(path string, perm os.FileMode) error {
+	if err := mkdirAllShared(path, perm); err != nil {
+		return fmt.Errorf("failed to create directory '%s': %w", path, err)
+	}
+	return nil
+}
+
+// outputDirMode returns the directory mode to use when creating shared output directories,
+// taken from the ORYX_OUTPUT_DIR_MODE environment variable (an octal string, e.g. "0775") when
+// set to a valid value, or defaultOutputDirMode otherwise.
+func outputDirMode() os.FileMode {
+	if modeStr := os.Getenv("ORYX_OUTPUT_DIR_MODE"); modeStr != "" {
+		if mode, err := strconv.ParseUint(modeStr, 8, 32); err == nil {
+			return os.FileMode(mode)
+		}
+		fmt.Println("Warning: ignoring invalid ORYX_OUTPUT_DIR_MODE '" + modeStr + "'")
+	}
+	return defaultOutputDirMode
+}
+
+// WriteScriptAtomic writes the entrypoint command to filePath atomically: it writes to a
+// sibling temp file in the same directory, fsyncs it, then renames it over filePath so a reader
+// never observes a partially-written script. If filePath already exists, its permissions are
+// preserved on the replacement; otherwise the script is made executable.
+func WriteScriptAtomic(filePath string, command string) error {
 	fmt.Println("Writing output script to '" + filePath + "'")
 
 	// Ensure directory
 	dir := filepath.Dir(filePath)
 	if !PathExists(dir) {
-		os.MkdirAll(dir, os.ModePerm)
+		if err := MkdirAllShared(dir, outputDirMode()); err != nil {
+			return err
+		}
+	}
+
+	tmpFile, err := ioutil.TempFile(dir, filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for '%s': %w", filePath, err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmpFile.WriteString(command); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write script '%s': %w", filePath, err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to sync script '%s': %w", filePath, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file for '%s': %w", filePath, err)
+	}
+	if err := os.Chmod(tmpPath, 0755); err != nil {
+		return fmt.Errorf("failed to set permissions on '%s': %w", tmpPath, err)
 	}
 
-	ioutil.WriteFile(filePath, []byte(command), 0755)
+	return RenameFileCopyPermissions(tmpPath, filePath)
 }
 
-// Appends command to a file
-func AppendScript(filePath string, command string) {
+// WriteScriptE writes the entrypoint command to an executable file, returning an error if the
+// destination directory can't be created or the file can't be written.
+func WriteScriptE(filePath string, command string) error {
+	return WriteScriptAtomic(filePath, command)
+}
+
+// Writes the entrypoint command to an executable file
+//
+// Deprecated: use WriteScriptE instead, which returns an error instead of swallowing it.
+func WriteScript(filePath string, command string) {
+	if err := WriteScriptE(filePath, command); err != nil {
+		fmt.Println("Warning: " + err.Error())
+	}
+}
+
+// WriteScriptIfChanged writes command to filePath only if it differs from what's already there,
+// determined by comparing SHA-256 digests rather than rewriting unconditionally, so that
+// repeated invocations with the same command don't needlessly bust Docker layer caches or
+// file-watch triggers. It returns whether a write actually happened. The digest is also written
+// to a "<filePath>.sha256" sidecar file so downstream tooling (CI cache keys, Kaniko layer
+// dedup) can key off it without re-reading the script.
+func WriteScriptIfChanged(filePath string, command string) (bool, error) {
+	newDigest := sha256.Sum256([]byte(command))
+	newDigestHex := hex.EncodeToString(newDigest[:])
+
+	if existing, err := os.Open(filePath); err == nil {
+		hasher := sha256.New()
+		_, copyErr := io.Copy(hasher, existing)
+		existing.Close()
+		if copyErr != nil {
+			return false, fmt.Errorf("failed to hash existing script '%s': %w", filePath, copyErr)
+		}
+		if hex.EncodeToString(hasher.Sum(nil)) == newDigestHex {
+			return false, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to open existing script '%s': %w", filePath, err)
+	}
+
+	if err := WriteScriptAtomic(filePath, command); err != nil {
+		return false, err
+	}
+	if err := WriteScriptAtomic(filePath+sha256SidecarSuffix, newDigestHex); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// AppendScriptE appends command to a file, returning an error if the destination directory is
+// missing or the file can't be opened or written to.
+func AppendScriptE(filePath string, command string) error {
 	if command == "" {
-		return
+		return nil
 	}
 	fmt.Println("Appending output script to '" + filePath + "'")
 
 	// Ensures directory
 	dir := filepath.Dir(filePath)
 	if !PathExists(dir) {
-		return
+		return fmt.Errorf("directory '%s' does not exist", dir)
 	}
 
 	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0755)
 	if err != nil {
-		return
+		return fmt.Errorf("failed to open file '%s': %w", filePath, err)
 	}
 	defer file.Close()
 
 	// Appends the command at the end of the file
 	if _, err := file.WriteString("\n" + command); err != nil {
-		return
+		return fmt.Errorf("failed to append to file '%s': %w", filePath, err)
+	}
+	return nil
+}
+
+// Appends command to a file
+//
+// Deprecated: use AppendScriptE instead, which returns an error instead of swallowing it.
+func AppendScript(filePath string, command string) {
+	if err := AppendScriptE(filePath, command); err != nil {
+		fmt.Println("Warning: " + err.Error())
 	}
 }
 
@@ -94,20 +345,33 @@ func TryAddPermission(filePath string, permission os.FileMode) bool {
 	return true
 }
 
+// ParseCommandAndAddExecutionPermissionE checks if the command is a file in app's repository
+// and adds execution permission to it, returning an error instead of panicking if the command
+// path can't be resolved.
+func ParseCommandAndAddExecutionPermissionE(commandString string, sourcePath string) (bool, error) {
+	absoluteFilePath, err := CanonicalizePath(filepath.Join(sourcePath, commandString), true)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve command path for '%s': %w", commandString, err)
+	}
+	if FileExists(absoluteFilePath) {
+		return TryAddPermission(absoluteFilePath, 0755), nil
+	}
+	if FileExists(commandString) {
+		return TryAddPermission(commandString, 0755), nil
+	}
+	return false, nil
+}
+
 // Check if the command is a file in app's repository and add execution permission to it
+//
+// Deprecated: use ParseCommandAndAddExecutionPermissionE instead, which returns an error
+// instead of panicking.
 func ParseCommandAndAddExecutionPermission(commandString string, sourcePath string) bool {
-	absoluteFilePath, err := filepath.Abs(filepath.Join(sourcePath, commandString))
+	result, err := ParseCommandAndAddExecutionPermissionE(commandString, sourcePath)
 	if err != nil {
 		panic(err)
-	} else {
-		if FileExists(absoluteFilePath) {
-			return TryAddPermission(absoluteFilePath, 0755)
-		}
-		if FileExists(commandString) {
-			return TryAddPermission(commandString, 0755)
-		}
-		return false
 	}
+	return result
 }
 
 func ExtendPathForCommand(command string, sourcePath string) string {
@@ -0,0 +1,449 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+// --------------------------------------------------------------------------------------------
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestGetSubPath(t *testing.T) {
+	tests := []struct {
+		name      string
+		parentDir string
+		subDir    string
+		want      string
+	}{
+		{"simple nesting", "/tmp/app", "/tmp/app/src/main.go", filepath.Join("src", "main.go")},
+		{"sub equals parent", "/tmp/app", "/tmp/app", ""},
+		{"sub not nested under parent", "/tmp/app", "/tmp/other/main.go", ""},
+		{"sub has parent as a string prefix but isn't nested", "/tmp/app", "/tmp/app2/main.go", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetSubPath(tt.parentDir, tt.subDir); got != tt.want {
+				t.Errorf("GetSubPath(%q, %q) = %q, want %q", tt.parentDir, tt.subDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSubPath_SymlinkedParent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires elevated privileges on Windows")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "oryx-getsubpath")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	target := filepath.Join(tmpDir, "actualtarget")
+	if err := os.MkdirAll(filepath.Join(target, "sub"), 0755); err != nil {
+		t.Fatalf("failed to create target dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(target, "sub", "existing.txt"), []byte("x"), 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	link := filepath.Join(tmpDir, "lnk")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	t.Run("missing subDir nested under the symlink itself", func(t *testing.T) {
+		subDir := filepath.Join(link, "sub", "doesnotexist.txt")
+		want := filepath.Join("sub", "doesnotexist.txt")
+		if got := GetSubPath(link, subDir); got != want {
+			t.Errorf("GetSubPath(%q, %q) = %q, want %q", link, subDir, got, want)
+		}
+	})
+
+	t.Run("subDir already expressed via the resolved target", func(t *testing.T) {
+		subDir := filepath.Join(target, "sub", "existing.txt")
+		want := filepath.Join("sub", "existing.txt")
+		if got := GetSubPath(link, subDir); got != want {
+			t.Errorf("GetSubPath(%q, %q) = %q, want %q", link, subDir, got, want)
+		}
+	})
+}
+
+func TestCanonicalizePath(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oryx-canonicalize")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if resolved, err := CanonicalizePath(tmpDir, false); err != nil {
+		t.Errorf("CanonicalizePath(%q, false) returned error: %v", tmpDir, err)
+	} else if !filepath.IsAbs(resolved) {
+		t.Errorf("CanonicalizePath(%q, false) = %q, want an absolute path", tmpDir, resolved)
+	}
+
+	missing := filepath.Join(tmpDir, "does-not-exist")
+	if _, err := CanonicalizePath(missing, false); err == nil {
+		t.Errorf("CanonicalizePath(%q, false) = nil error, want an error for a missing path", missing)
+	}
+
+	if got, err := CanonicalizePath(missing, true); err != nil {
+		t.Errorf("CanonicalizePath(%q, true) returned unexpected error: %v", missing, err)
+	} else if !filepath.IsAbs(got) {
+		t.Errorf("CanonicalizePath(%q, true) = %q, want an absolute path", missing, got)
+	}
+}
+
+func TestCygwinDriveRe(t *testing.T) {
+	tests := []struct {
+		path    string
+		matches bool
+	}{
+		{"/c/src/app", true},
+		{"/cygdrive/c/src/app", true},
+		{"/mnt/c/src/app", true},
+		{"/home/user/app", false},
+	}
+
+	for _, tt := range tests {
+		if got := cygwinDriveRe.MatchString(tt.path); got != tt.matches {
+			t.Errorf("cygwinDriveRe.MatchString(%q) = %v, want %v", tt.path, got, tt.matches)
+		}
+	}
+}
+
+func TestOutputDirMode(t *testing.T) {
+	defer os.Unsetenv("ORYX_OUTPUT_DIR_MODE")
+
+	os.Unsetenv("ORYX_OUTPUT_DIR_MODE")
+	if got := outputDirMode(); got != defaultOutputDirMode {
+		t.Errorf("outputDirMode() with no ORYX_OUTPUT_DIR_MODE = %v, want default %v", got, defaultOutputDirMode)
+	}
+
+	os.Setenv("ORYX_OUTPUT_DIR_MODE", "0770")
+	if want := os.FileMode(0770); outputDirMode() != want {
+		t.Errorf("outputDirMode() with ORYX_OUTPUT_DIR_MODE=0770 = %v, want %v", outputDirMode(), want)
+	}
+
+	os.Setenv("ORYX_OUTPUT_DIR_MODE", "not-an-octal-number")
+	if got := outputDirMode(); got != defaultOutputDirMode {
+		t.Errorf("outputDirMode() with an invalid ORYX_OUTPUT_DIR_MODE = %v, want fallback to default %v", got, defaultOutputDirMode)
+	}
+}
+
+func TestWriteScriptAtomic(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oryx-writescript")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	filePath := filepath.Join(tmpDir, "nested", "run.sh")
+	if err := WriteScriptAtomic(filePath, "echo hello"); err != nil {
+		t.Fatalf("WriteScriptAtomic returned error: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("failed to read written script: %v", err)
+	}
+	if string(contents) != "echo hello" {
+		t.Errorf("script contents = %q, want %q", contents, "echo hello")
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		t.Fatalf("failed to list directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("destination directory has %d entries, want 1 (no leftover temp files): %v", len(entries), entries)
+	}
+}
+
+func TestWriteScriptAtomic_PreservesExistingPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("POSIX permission bits aren't meaningful on Windows")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "oryx-writescript-perms")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	filePath := filepath.Join(tmpDir, "run.sh")
+	if err := ioutil.WriteFile(filePath, []byte("old"), 0700); err != nil {
+		t.Fatalf("failed to seed existing file: %v", err)
+	}
+
+	if err := WriteScriptAtomic(filePath, "new"); err != nil {
+		t.Fatalf("WriteScriptAtomic returned error: %v", err)
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatalf("failed to stat written file: %v", err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("file mode = %v, want %v", info.Mode().Perm(), os.FileMode(0700))
+	}
+}
+
+func TestWriteScriptAtomic_CleansUpTempFileOnFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on a unix rename-onto-a-directory failure mode")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "oryx-writescript-failure")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Make the destination a non-empty directory, so WriteScriptAtomic's temp file gets
+	// created and written successfully, but the final rename onto filePath fails.
+	filePath := filepath.Join(tmpDir, "run.sh")
+	if err := os.Mkdir(filePath, 0755); err != nil {
+		t.Fatalf("failed to create directory in place of the destination file: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(filePath, "placeholder"), []byte("x"), 0644); err != nil {
+		t.Fatalf("failed to seed placeholder file: %v", err)
+	}
+
+	if err := WriteScriptAtomic(filePath, "echo hello"); err == nil {
+		t.Fatalf("WriteScriptAtomic = nil error, want an error because the rename must fail")
+	}
+
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to list directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "run.sh" {
+		t.Errorf("destination directory entries = %v, want only the original 'run.sh' directory (the temp file should have been cleaned up)", entries)
+	}
+}
+
+func TestWriteScriptIfChanged(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oryx-writeifchanged")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	filePath := filepath.Join(tmpDir, "run.sh")
+
+	changed, err := WriteScriptIfChanged(filePath, "echo hello")
+	if err != nil {
+		t.Fatalf("WriteScriptIfChanged returned error: %v", err)
+	}
+	if !changed {
+		t.Errorf("first write: changed = false, want true")
+	}
+	if !FileExists(filePath + sha256SidecarSuffix) {
+		t.Errorf("sidecar digest file %q was not created", filePath+sha256SidecarSuffix)
+	}
+
+	changed, err = WriteScriptIfChanged(filePath, "echo hello")
+	if err != nil {
+		t.Fatalf("WriteScriptIfChanged returned error: %v", err)
+	}
+	if changed {
+		t.Errorf("rewrite with an identical command: changed = true, want false")
+	}
+
+	changed, err = WriteScriptIfChanged(filePath, "echo goodbye")
+	if err != nil {
+		t.Fatalf("WriteScriptIfChanged returned error: %v", err)
+	}
+	if !changed {
+		t.Errorf("write with a different command: changed = false, want true")
+	}
+
+	contents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("failed to read script: %v", err)
+	}
+	if string(contents) != "echo goodbye" {
+		t.Errorf("script contents = %q, want %q", contents, "echo goodbye")
+	}
+}
+
+func TestExpandUserPath(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatalf("failed to determine current user: %v", err)
+	}
+
+	t.Run("tilde alone", func(t *testing.T) {
+		got, err := ExpandUserPath("~")
+		if err != nil {
+			t.Fatalf(`ExpandUserPath("~") returned error: %v`, err)
+		}
+		if got != currentUser.HomeDir {
+			t.Errorf(`ExpandUserPath("~") = %q, want %q`, got, currentUser.HomeDir)
+		}
+	})
+
+	t.Run("tilde-prefixed path", func(t *testing.T) {
+		got, err := ExpandUserPath("~/myapp")
+		if err != nil {
+			t.Fatalf(`ExpandUserPath("~/myapp") returned error: %v`, err)
+		}
+		if want := filepath.Join(currentUser.HomeDir, "myapp"); got != want {
+			t.Errorf(`ExpandUserPath("~/myapp") = %q, want %q`, got, want)
+		}
+	})
+
+	t.Run("named user", func(t *testing.T) {
+		lookedUpUser, err := user.Lookup(currentUser.Username)
+		if err != nil {
+			t.Skipf("user.Lookup(%q) unavailable in this environment: %v", currentUser.Username, err)
+		}
+
+		got, err := ExpandUserPath("~" + currentUser.Username + "/output")
+		if err != nil {
+			t.Fatalf("ExpandUserPath for a named user returned error: %v", err)
+		}
+		if want := filepath.Join(lookedUpUser.HomeDir, "output"); got != want {
+			t.Errorf("ExpandUserPath for a named user = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("unknown named user returns an error", func(t *testing.T) {
+		if _, err := ExpandUserPath("~oryx-test-user-that-should-not-exist/output"); err == nil {
+			t.Errorf("ExpandUserPath for an unknown user = nil error, want an error")
+		}
+	})
+
+	t.Run("set environment variable is expanded", func(t *testing.T) {
+		os.Setenv("ORYX_TEST_EXPANDUSERPATH_VAR", "/set-value")
+		defer os.Unsetenv("ORYX_TEST_EXPANDUSERPATH_VAR")
+
+		got, err := ExpandUserPath("$ORYX_TEST_EXPANDUSERPATH_VAR/output")
+		if err != nil {
+			t.Fatalf("ExpandUserPath returned error: %v", err)
+		}
+		if want := "/set-value/output"; got != want {
+			t.Errorf("ExpandUserPath = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("unset environment variable expands to an empty string", func(t *testing.T) {
+		os.Unsetenv("ORYX_TEST_EXPANDUSERPATH_UNSET_VAR")
+
+		got, err := ExpandUserPath("$ORYX_TEST_EXPANDUSERPATH_UNSET_VAR/output")
+		if err != nil {
+			t.Fatalf("ExpandUserPath returned error: %v", err)
+		}
+		if want := "/output"; got != want {
+			t.Errorf("ExpandUserPath = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("path with neither a tilde nor an env var is left untouched", func(t *testing.T) {
+		got, err := ExpandUserPath("/already/absolute")
+		if err != nil {
+			t.Fatalf("ExpandUserPath returned error: %v", err)
+		}
+		if want := "/already/absolute"; got != want {
+			t.Errorf("ExpandUserPath = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestGetValidatedFullPathE(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oryx-getvalidatedfullpath")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if got, err := GetValidatedFullPathE(tmpDir); err != nil {
+		t.Errorf("GetValidatedFullPathE(%q) returned unexpected error: %v", tmpDir, err)
+	} else if !filepath.IsAbs(got) {
+		t.Errorf("GetValidatedFullPathE(%q) = %q, want an absolute path", tmpDir, got)
+	}
+
+	missing := filepath.Join(tmpDir, "does-not-exist")
+	if _, err := GetValidatedFullPathE(missing); err == nil {
+		t.Errorf("GetValidatedFullPathE(%q) = nil error, want an error for a missing path", missing)
+	}
+}
+
+func TestAppendScriptE(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "oryx-appendscript")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	missingDirFile := filepath.Join(tmpDir, "does-not-exist", "run.sh")
+	if err := AppendScriptE(missingDirFile, "echo appended"); err == nil {
+		t.Errorf("AppendScriptE with a missing destination directory = nil error, want an error")
+	}
+
+	filePath := filepath.Join(tmpDir, "run.sh")
+	if err := ioutil.WriteFile(filePath, []byte("echo first"), 0755); err != nil {
+		t.Fatalf("failed to seed script: %v", err)
+	}
+
+	if err := AppendScriptE(filePath, "echo second"); err != nil {
+		t.Fatalf("AppendScriptE returned error: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("failed to read script: %v", err)
+	}
+	if want := "echo first\necho second"; string(contents) != want {
+		t.Errorf("script contents = %q, want %q", contents, want)
+	}
+}
+
+func TestParseCommandAndAddExecutionPermissionE(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("POSIX permission bits aren't meaningful on Windows")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "oryx-parsecommand")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	scriptPath := filepath.Join(tmpDir, "start.sh")
+	if err := ioutil.WriteFile(scriptPath, []byte("echo hi"), 0644); err != nil {
+		t.Fatalf("failed to create script: %v", err)
+	}
+
+	added, err := ParseCommandAndAddExecutionPermissionE("start.sh", tmpDir)
+	if err != nil {
+		t.Fatalf("ParseCommandAndAddExecutionPermissionE returned error: %v", err)
+	}
+	if !added {
+		t.Errorf("ParseCommandAndAddExecutionPermissionE(%q, %q) = false, want true", "start.sh", tmpDir)
+	}
+	info, err := os.Stat(scriptPath)
+	if err != nil {
+		t.Fatalf("failed to stat script: %v", err)
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		t.Errorf("script mode = %v, want execute bits set", info.Mode().Perm())
+	}
+
+	added, err = ParseCommandAndAddExecutionPermissionE("not-a-real-command", tmpDir)
+	if err != nil {
+		t.Fatalf("ParseCommandAndAddExecutionPermissionE returned error: %v", err)
+	}
+	if added {
+		t.Errorf("ParseCommandAndAddExecutionPermissionE with a nonexistent command = true, want false")
+	}
+}
@@ -0,0 +1,32 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+// --------------------------------------------------------------------------------------------
+
+//go:build !windows
+// +build !windows
+
+package common
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes access to the process umask, which syscall.Umask mutates globally rather
+// than per-goroutine. Without this, concurrent mkdirAllShared calls can race and leave the
+// process umask permanently changed.
+var umaskMu sync.Mutex
+
+// mkdirAllShared creates path (and any missing parents) with perm as the effective on-disk
+// mode, by temporarily clearing the process umask for the duration of the call.
+func mkdirAllShared(path string, perm os.FileMode) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+
+	oldUmask := syscall.Umask(0)
+	defer syscall.Umask(oldUmask)
+
+	return os.MkdirAll(path, perm)
+}
@@ -0,0 +1,65 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+// --------------------------------------------------------------------------------------------
+
+//go:build !windows
+// +build !windows
+
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestMkdirAllShared_ConcurrentCallsDoNotCorruptUmask(t *testing.T) {
+	// A restrictive umask makes the mode assertion below meaningful: if MkdirAllShared ever
+	// stopped overriding the umask, the created directories would come out as 0700, not 0755.
+	const testUmask = 0077
+	const wantMode = os.FileMode(0755)
+
+	originalUmask := syscall.Umask(testUmask)
+	defer syscall.Umask(originalUmask)
+
+	tmpDir, err := ioutil.TempDir("", "oryx-mkdirshared")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dir := filepath.Join(tmpDir, fmt.Sprintf("d%d", i))
+			if err := MkdirAllShared(dir, wantMode); err != nil {
+				t.Errorf("MkdirAllShared failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		dir := filepath.Join(tmpDir, fmt.Sprintf("d%d", i))
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatalf("failed to stat %q: %v", dir, err)
+		}
+		if info.Mode().Perm() != wantMode {
+			t.Errorf("directory %q mode = %v, want %v regardless of the process umask", dir, info.Mode().Perm(), wantMode)
+		}
+	}
+
+	gotUmask := syscall.Umask(testUmask)
+	syscall.Umask(gotUmask)
+	if gotUmask != testUmask {
+		t.Errorf("process umask = %o after concurrent MkdirAllShared calls, want %o (unchanged)", gotUmask, testUmask)
+	}
+}
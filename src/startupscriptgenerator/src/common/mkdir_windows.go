@@ -0,0 +1,17 @@
+// --------------------------------------------------------------------------------------------
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+// --------------------------------------------------------------------------------------------
+
+//go:build windows
+// +build windows
+
+package common
+
+import "os"
+
+// mkdirAllShared creates path (and any missing parents). Windows has no POSIX umask to work
+// around, so this degrades to a plain os.MkdirAll.
+func mkdirAllShared(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}